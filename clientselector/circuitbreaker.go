@@ -0,0 +1,83 @@
+package clientselector
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type breakerState int32
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker is a per-server circuit breaker with the usual three states:
+// closed (requests flow normally), open (requests are rejected until
+// BreakerCooldown elapses) and half-open (a single probe request is
+// admitted to decide whether to close or re-open).
+type breaker struct {
+	state               int32 // breakerState, accessed atomically
+	consecutiveFailures int64
+	openedAt            int64 // UnixNano, accessed atomically
+}
+
+// allow reports whether a request may be dispatched to this server right
+// now, transitioning open -> half-open once cooldown has elapsed. This has
+// a side effect (it claims the single half-open probe slot), so it must
+// only be called for the server a selection actually settled on, never for
+// every candidate while narrowing down the field.
+func (b *breaker) allow(cooldown time.Duration) bool {
+	switch breakerState(atomic.LoadInt32(&b.state)) {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Since(time.Unix(0, atomic.LoadInt64(&b.openedAt))) < cooldown {
+			return false
+		}
+		// cooldown elapsed: admit exactly one probe.
+		return atomic.CompareAndSwapInt32(&b.state, int32(breakerOpen), int32(breakerHalfOpen))
+	default: // breakerHalfOpen: a probe is already in flight.
+		return false
+	}
+}
+
+// candidate is the read-only counterpart of allow: it reports whether the
+// server is worth considering at all, without claiming the half-open probe
+// slot. Used to build the candidate list a select mode picks from; allow
+// itself is reserved for the one server that selection settles on.
+func (b *breaker) candidate(cooldown time.Duration) bool {
+	switch breakerState(atomic.LoadInt32(&b.state)) {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		return time.Since(time.Unix(0, atomic.LoadInt64(&b.openedAt))) >= cooldown
+	default: // breakerHalfOpen: a probe is already in flight.
+		return false
+	}
+}
+
+// onFailure records a failed call. A failed half-open probe re-opens the
+// breaker immediately; enough consecutive failures from closed does too.
+func (b *breaker) onFailure(threshold int) {
+	if breakerState(atomic.LoadInt32(&b.state)) == breakerHalfOpen {
+		b.trip()
+		return
+	}
+	if atomic.AddInt64(&b.consecutiveFailures, 1) >= int64(threshold) {
+		b.trip()
+	}
+}
+
+func (b *breaker) trip() {
+	atomic.StoreInt64(&b.openedAt, time.Now().UnixNano())
+	atomic.StoreInt32(&b.state, int32(breakerOpen))
+}
+
+// onSuccess records a successful call, closing the breaker (including a
+// successful half-open probe) and resetting its failure count.
+func (b *breaker) onSuccess() {
+	atomic.StoreInt64(&b.consecutiveFailures, 0)
+	atomic.StoreInt32(&b.state, int32(breakerClosed))
+}
@@ -0,0 +1,107 @@
+package clientselector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerClosedAlwaysAllows(t *testing.T) {
+	b := &breaker{}
+	if !b.allow(time.Second) {
+		t.Fatalf("a fresh breaker must start closed and admit requests")
+	}
+	if !b.candidate(time.Second) {
+		t.Fatalf("a fresh breaker must be a candidate")
+	}
+}
+
+func TestBreakerTripsAfterThreshold(t *testing.T) {
+	b := &breaker{}
+	const threshold = 3
+	for i := 0; i < threshold-1; i++ {
+		b.onFailure(threshold)
+		if breakerState(b.state) != breakerClosed {
+			t.Fatalf("breaker should stay closed before the threshold is hit")
+		}
+	}
+	b.onFailure(threshold)
+	if breakerState(b.state) != breakerOpen {
+		t.Fatalf("breaker should trip open once consecutive failures reach the threshold")
+	}
+}
+
+func TestBreakerOpenBlocksUntilCooldown(t *testing.T) {
+	b := &breaker{}
+	b.trip()
+
+	if b.allow(time.Minute) {
+		t.Fatalf("an open breaker must block requests before its cooldown elapses")
+	}
+	if b.candidate(time.Minute) {
+		t.Fatalf("an open breaker must not be a candidate before its cooldown elapses")
+	}
+}
+
+// TestBreakerCandidateDoesNotConsumeTheHalfOpenProbe guards against the
+// chunk0-5 regression where building the eligible-servers list spent every
+// candidate's single half-open probe, permanently starving recovered
+// servers that the select mode didn't happen to pick that round.
+func TestBreakerCandidateDoesNotConsumeTheHalfOpenProbe(t *testing.T) {
+	b := &breaker{}
+	b.trip()
+	b.openedAt = time.Now().Add(-time.Minute).UnixNano()
+
+	for i := 0; i < 5; i++ {
+		if !b.candidate(time.Second) {
+			t.Fatalf("candidate should keep reporting true once cooldown has elapsed")
+		}
+	}
+	if breakerState(b.state) != breakerOpen {
+		t.Fatalf("candidate must never claim the half-open probe slot; state = %v", breakerState(b.state))
+	}
+}
+
+func TestBreakerAllowClaimsASingleHalfOpenProbe(t *testing.T) {
+	b := &breaker{}
+	b.trip()
+	b.openedAt = time.Now().Add(-time.Minute).UnixNano()
+
+	if !b.allow(time.Second) {
+		t.Fatalf("expected the first allow() after cooldown to claim the probe")
+	}
+	if breakerState(b.state) != breakerHalfOpen {
+		t.Fatalf("expected breaker to be half-open after claiming the probe")
+	}
+	if b.allow(time.Second) {
+		t.Fatalf("a second allow() must not claim a probe that's already in flight")
+	}
+}
+
+func TestBreakerOnSuccessClosesFromHalfOpen(t *testing.T) {
+	b := &breaker{}
+	b.trip()
+	b.openedAt = time.Now().Add(-time.Minute).UnixNano()
+	b.allow(time.Second) // claim the probe, moving to half-open
+
+	b.onSuccess()
+
+	if breakerState(b.state) != breakerClosed {
+		t.Fatalf("a successful probe must close the breaker")
+	}
+	if !b.allow(time.Second) {
+		t.Fatalf("a closed breaker must admit requests again")
+	}
+}
+
+func TestBreakerOnFailureReopensFromHalfOpen(t *testing.T) {
+	b := &breaker{}
+	b.trip()
+	b.openedAt = time.Now().Add(-time.Minute).UnixNano()
+	b.allow(time.Second) // claim the probe
+
+	b.onFailure(5)
+
+	if breakerState(b.state) != breakerOpen {
+		t.Fatalf("a failed probe must re-open the breaker immediately, regardless of threshold")
+	}
+}
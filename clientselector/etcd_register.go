@@ -0,0 +1,108 @@
+package clientselector
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/smallnest/rpcx/log"
+	"go.etcd.io/etcd/clientv3"
+	"golang.org/x/net/context"
+)
+
+// EtcdV3Register registers a server under BasePath/ServiceAddress in etcd
+// using a TTL lease instead of relying on v2 directory expirations. The
+// lease is kept alive in the background for as long as the register is
+// not Unregister()-ed, so a crashed server disappears within one TTL
+// cycle even though nobody ever called Unregister explicitly.
+type EtcdV3Register struct {
+	EtcdServers    []string
+	BasePath       string //should endwith serviceName
+	ServiceAddress string //network@addr, e.g. tcp@127.0.0.1:8972
+	Metadata       string // url-encoded "weight=1&group=&state=active", etc.
+
+	TTL         time.Duration
+	DialTimeout time.Duration
+	Username    string
+	Password    string
+	TLSConfig   *tls.Config
+
+	client  *clientv3.Client
+	leaseID clientv3.LeaseID
+	cancel  context.CancelFunc
+}
+
+// NewEtcdV3Register creates a EtcdV3Register. ttl is the lease TTL (in whole
+// seconds) and, unless DialTimeout is set, also the dial timeout; it should
+// be well above the etcd round trip time.
+func NewEtcdV3Register(etcdServers []string, basePath, serviceAddress, metadata string, ttl time.Duration) *EtcdV3Register {
+	return &EtcdV3Register{
+		EtcdServers:    etcdServers,
+		BasePath:       basePath,
+		ServiceAddress: serviceAddress,
+		Metadata:       metadata,
+		TTL:            ttl,
+	}
+}
+
+// Register grants a lease, puts the service key under it and starts a
+// background goroutine that keeps the lease alive until Unregister is
+// called.
+func (r *EtcdV3Register) Register() error {
+	dialTimeout := r.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = r.TTL
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   r.EtcdServers,
+		DialTimeout: dialTimeout,
+		Username:    r.Username,
+		Password:    r.Password,
+		TLS:         r.TLSConfig,
+	})
+	if err != nil {
+		return err
+	}
+	r.client = cli
+
+	lease, err := cli.Grant(context.Background(), int64(r.TTL.Seconds()))
+	if err != nil {
+		return err
+	}
+	r.leaseID = lease.ID
+
+	key := r.BasePath + "/" + r.ServiceAddress
+	if _, err := cli.Put(context.Background(), key, r.Metadata, clientv3.WithLease(r.leaseID)); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+
+	keepAliveCh, err := cli.KeepAlive(ctx, r.leaseID)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for range keepAliveCh {
+			// drain the channel; etcd has re-granted the lease.
+		}
+		log.Infof("etcd keepalive for %s stopped", key)
+	}()
+
+	return nil
+}
+
+// Unregister revokes the lease, which removes the service key immediately
+// instead of waiting out the remainder of the TTL.
+func (r *EtcdV3Register) Unregister() error {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	if r.client == nil {
+		return nil
+	}
+	_, err := r.client.Revoke(context.Background(), r.leaseID)
+	return err
+}
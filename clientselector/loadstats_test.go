@@ -0,0 +1,57 @@
+package clientselector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServerStatScoreOrdering(t *testing.T) {
+	busy := &serverStat{}
+	busy.start()
+	busy.start()
+
+	idle := &serverStat{}
+
+	if busy.score() <= idle.score() {
+		t.Fatalf("a busier server must score higher (less preferable for P2C/LeastLoaded) than an idle one")
+	}
+}
+
+func TestServerStatDoneReleasesSlotAndSeedsEWMA(t *testing.T) {
+	st := &serverStat{}
+	st.start()
+	st.done(100 * time.Millisecond)
+
+	if st.outstanding != 0 {
+		t.Fatalf("expected outstanding to drop back to 0, got %d", st.outstanding)
+	}
+	if st.ewmaRTT != int64(100*time.Millisecond) {
+		t.Fatalf("expected the first done() call to seed ewmaRTT with the raw rtt, got %d", st.ewmaRTT)
+	}
+}
+
+func TestServerStatDoneFoldsSubsequentRTTsIntoEWMA(t *testing.T) {
+	st := &serverStat{}
+	st.start()
+	st.done(100 * time.Millisecond)
+	st.start()
+	st.done(200 * time.Millisecond)
+
+	// second RTT is higher, so the EWMA should land strictly between the two.
+	if st.ewmaRTT <= int64(100*time.Millisecond) || st.ewmaRTT >= int64(200*time.Millisecond) {
+		t.Fatalf("expected ewmaRTT to be folded between successive RTTs, got %d", st.ewmaRTT)
+	}
+}
+
+func TestServerStatFailReleasesSlotWithoutTouchingEWMA(t *testing.T) {
+	st := &serverStat{ewmaRTT: 42}
+	st.start()
+	st.fail()
+
+	if st.outstanding != 0 {
+		t.Fatalf("expected outstanding to drop back to 0, got %d", st.outstanding)
+	}
+	if st.ewmaRTT != 42 {
+		t.Fatalf("fail() must not touch ewmaRTT, got %d", st.ewmaRTT)
+	}
+}
@@ -0,0 +1,139 @@
+// Package consul implements registry.Registry on top of Consul's health API.
+package consul
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	capi "github.com/hashicorp/consul/api"
+	"github.com/smallnest/rpcx/clientselector/registry"
+	"golang.org/x/net/context"
+)
+
+// Registry is a registry.Registry backed by Consul's health checks; only passing instances are returned.
+type Registry struct {
+	ServiceName string
+
+	client *capi.Client
+}
+
+// New creates a Registry that watches serviceName on the Consul agent at
+// addr (empty for the local agent's default address).
+func New(addr, serviceName string) (*Registry, error) {
+	cfg := capi.DefaultConfig()
+	if addr != "" {
+		cfg.Address = addr
+	}
+	client, err := capi.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Registry{ServiceName: serviceName, client: client}, nil
+}
+
+// List implements registry.Registry.
+func (r *Registry) List(ctx context.Context) ([]registry.ServiceInstance, error) {
+	entries, _, err := r.client.Health().Service(r.ServiceName, "", true, &capi.QueryOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return toInstances(entries), nil
+}
+
+// Watch implements registry.Registry via a blocking-query loop, diffing each response against what it last reported.
+func (r *Registry) Watch(ctx context.Context) (<-chan registry.RegistryEvent, error) {
+	ch := make(chan registry.RegistryEvent)
+
+	go func() {
+		defer close(ch)
+
+		var lastIndex uint64
+		seen := map[string]registry.ServiceInstance{}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			opts := (&capi.QueryOptions{
+				WaitIndex: lastIndex,
+				WaitTime:  5 * time.Minute,
+			}).WithContext(ctx)
+			entries, meta, err := r.client.Health().Service(r.ServiceName, "", true, opts)
+			if err != nil {
+				time.Sleep(time.Second)
+				continue
+			}
+			lastIndex = meta.LastIndex
+
+			next := toInstances(entries)
+			nextByKey := make(map[string]registry.ServiceInstance, len(next))
+			for _, inst := range next {
+				nextByKey[inst.Key()] = inst
+			}
+
+			for key, inst := range nextByKey {
+				if prev, ok := seen[key]; !ok || !prev.Equal(inst) {
+					ch <- registry.RegistryEvent{Type: registry.EventTypePut, Instance: inst}
+				}
+			}
+			for key, inst := range seen {
+				if _, ok := nextByKey[key]; !ok {
+					ch <- registry.RegistryEvent{Type: registry.EventTypeDelete, Instance: inst}
+				}
+			}
+			seen = nextByKey
+		}
+	}()
+
+	return ch, nil
+}
+
+// Close implements registry.Registry. Consul's API client has no
+// connection to tear down.
+func (r *Registry) Close() error {
+	return nil
+}
+
+func toInstances(entries []*capi.ServiceEntry) []registry.ServiceInstance {
+	instances := make([]registry.ServiceInstance, 0, len(entries))
+	for _, e := range entries {
+		meta := e.Service.Meta
+		inst := registry.ServiceInstance{
+			Network:  meta["network"],
+			Address:  e.Service.Address + ":" + strconv.Itoa(e.Service.Port),
+			Weight:   1,
+			Group:    meta["group"],
+			State:    "active",
+			Metadata: meta,
+		}
+		if inst.Network == "" {
+			inst.Network = "tcp"
+		}
+		if w, ok := meta["weight"]; ok {
+			if weight, err := strconv.Atoi(w); err == nil {
+				inst.Weight = weight
+			}
+		}
+		if lat, ok := meta["latitude"]; ok {
+			if f, err := strconv.ParseFloat(lat, 64); err == nil {
+				inst.Latitude = f
+			}
+		}
+		if lng, ok := meta["longitude"]; ok {
+			if f, err := strconv.ParseFloat(lng, 64); err == nil {
+				inst.Longitude = f
+			}
+		}
+		values := url.Values{}
+		for k, v := range meta {
+			values.Set(k, v)
+		}
+		inst.Raw = values.Encode()
+		instances = append(instances, inst)
+	}
+	return instances
+}
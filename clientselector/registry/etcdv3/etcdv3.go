@@ -0,0 +1,151 @@
+// Package etcdv3 implements registry.Registry on top of go.etcd.io/etcd/clientv3.
+package etcdv3
+
+import (
+	"crypto/tls"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smallnest/rpcx/clientselector/registry"
+	"go.etcd.io/etcd/clientv3"
+	"golang.org/x/net/context"
+)
+
+// Options configures dialing the etcd cluster.
+type Options struct {
+	Username    string
+	Password    string
+	TLSConfig   *tls.Config
+	DialTimeout time.Duration
+}
+
+// Registry is a registry.Registry backed by etcd's clientv3 API, discovered via a prefix Get/Watch on BasePath.
+type Registry struct {
+	BasePath string
+
+	client *clientv3.Client
+}
+
+// New dials etcd and returns a Registry scoped to basePath.
+func New(etcdServers []string, basePath string, options Options) (*Registry, error) {
+	dialTimeout := options.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = 5 * time.Second
+	}
+
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   etcdServers,
+		DialTimeout: dialTimeout,
+		Username:    options.Username,
+		Password:    options.Password,
+		TLS:         options.TLSConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Registry{BasePath: basePath, client: cli}, nil
+}
+
+// List implements registry.Registry.
+func (r *Registry) List(ctx context.Context) ([]registry.ServiceInstance, error) {
+	resp, err := r.client.Get(ctx, r.BasePath, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make([]registry.ServiceInstance, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		inst, active := r.toInstance(string(kv.Key), string(kv.Value))
+		if active {
+			instances = append(instances, inst)
+		}
+	}
+	return instances, nil
+}
+
+// Watch implements registry.Registry.
+func (r *Registry) Watch(ctx context.Context) (<-chan registry.RegistryEvent, error) {
+	ch := make(chan registry.RegistryEvent)
+
+	go func() {
+		defer close(ch)
+
+		watcher := clientv3.NewWatcher(r.client)
+		defer watcher.Close()
+
+		rch := watcher.Watch(ctx, r.BasePath, clientv3.WithPrefix())
+		for wresp := range rch {
+			if wresp.Canceled || wresp.Err() != nil {
+				return
+			}
+			for _, ev := range wresp.Events {
+				switch ev.Type {
+				case clientv3.EventTypePut:
+					inst, active := r.toInstance(string(ev.Kv.Key), string(ev.Kv.Value))
+					if active {
+						ch <- registry.RegistryEvent{Type: registry.EventTypePut, Instance: inst}
+					} else {
+						ch <- registry.RegistryEvent{Type: registry.EventTypeDelete, Instance: inst}
+					}
+				case clientv3.EventTypeDelete:
+					inst, _ := r.toInstance(string(ev.Kv.Key), "")
+					ch <- registry.RegistryEvent{Type: registry.EventTypeDelete, Instance: inst}
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// Close implements registry.Registry.
+func (r *Registry) Close() error {
+	return r.client.Close()
+}
+
+// toInstance turns an etcd key/value pair into a ServiceInstance, and
+// reports whether its state is "active" (group filtering happens upstream).
+func (r *Registry) toInstance(key, value string) (registry.ServiceInstance, bool) {
+	server := strings.TrimPrefix(key, r.BasePath+"/")
+	ss := strings.SplitN(server, "@", 2)
+	inst := registry.ServiceInstance{Weight: 1, State: "active", Metadata: make(map[string]string), Raw: value}
+	if len(ss) == 2 {
+		inst.Network, inst.Address = ss[0], ss[1]
+	} else {
+		inst.Address = server
+	}
+
+	active := true
+	if v, err := url.ParseQuery(value); err == nil {
+		for k := range v {
+			inst.Metadata[k] = v.Get(k)
+		}
+		if w := v.Get("weight"); w != "" {
+			if weight, err := strconv.Atoi(w); err == nil {
+				inst.Weight = weight
+			}
+		}
+		inst.Group = v.Get("group")
+		if state := v.Get("state"); state != "" {
+			inst.State = state
+			if state != "active" {
+				active = false
+			}
+		}
+		if lat := v.Get("latitude"); lat != "" {
+			if f, err := strconv.ParseFloat(lat, 64); err == nil {
+				inst.Latitude = f
+			}
+		}
+		if lng := v.Get("longitude"); lng != "" {
+			if f, err := strconv.ParseFloat(lng, 64); err == nil {
+				inst.Longitude = f
+			}
+		}
+	}
+
+	return inst, active
+}
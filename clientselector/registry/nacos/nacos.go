@@ -0,0 +1,177 @@
+// Package nacos implements registry.Registry on top of the Nacos naming service's subscribe API.
+package nacos
+
+import (
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/nacos-group/nacos-sdk-go/clients"
+	"github.com/nacos-group/nacos-sdk-go/clients/naming_client"
+	"github.com/nacos-group/nacos-sdk-go/common/constant"
+	"github.com/nacos-group/nacos-sdk-go/model"
+	"github.com/nacos-group/nacos-sdk-go/vo"
+	"github.com/smallnest/rpcx/clientselector/registry"
+	"golang.org/x/net/context"
+)
+
+// Registry is a registry.Registry backed by a Nacos naming client. NacosGroup is Nacos' own grouping concept
+// (defaults to "DEFAULT_GROUP"), separate from rpcx's Group, which travels as the "group" metadata entry.
+type Registry struct {
+	ServiceName string
+	NacosGroup  string
+
+	client naming_client.INamingClient
+}
+
+// New creates a Registry that subscribes to serviceName on the given Nacos
+// servers.
+func New(serverAddrs []string, namespaceID, serviceName, nacosGroup string) (*Registry, error) {
+	serverConfigs := make([]constant.ServerConfig, 0, len(serverAddrs))
+	for _, addr := range serverAddrs {
+		serverConfigs = append(serverConfigs, *constant.NewServerConfig(addr, 8848))
+	}
+
+	client, err := clients.CreateNamingClient(map[string]interface{}{
+		"serverConfigs": serverConfigs,
+		"clientConfig":  *constant.NewClientConfig(constant.WithNamespaceId(namespaceID)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Registry{ServiceName: serviceName, NacosGroup: nacosGroup, client: client}, nil
+}
+
+// List implements registry.Registry.
+func (r *Registry) List(ctx context.Context) ([]registry.ServiceInstance, error) {
+	instances, err := r.client.SelectInstances(vo.SelectInstancesParam{
+		ServiceName: r.ServiceName,
+		GroupName:   r.NacosGroup,
+		HealthyOnly: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toInstances(instances), nil
+}
+
+// Watch implements registry.Registry by subscribing to Nacos push notifications and diffing each callback.
+func (r *Registry) Watch(ctx context.Context) (<-chan registry.RegistryEvent, error) {
+	ch := make(chan registry.RegistryEvent)
+	seen := map[string]registry.ServiceInstance{}
+
+	// The Nacos SDK can still invoke SubscribeCallback concurrently with
+	// (or after) Unsubscribe, so a send must never race the close(ch)
+	// below. mu makes "is ch closed yet" and "send on ch" atomic with each
+	// other: the closer only closes ch after taking mu, so any send that
+	// wins the race to acquire mu first is guaranteed to finish before
+	// close(ch) runs, and any send that loses sees closed and backs off.
+	var mu sync.Mutex
+	closed := false
+	send := func(ev registry.RegistryEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		ch <- ev
+	}
+
+	param := &vo.SubscribeParam{
+		ServiceName: r.ServiceName,
+		GroupName:   r.NacosGroup,
+		SubscribeCallback: func(services []model.SubscribeService, err error) {
+			if err != nil {
+				return
+			}
+			instances := make([]model.Instance, 0, len(services))
+			for _, svc := range services {
+				instances = append(instances, model.Instance{
+					Ip:       svc.Ip,
+					Port:     svc.Port,
+					Weight:   svc.Weight,
+					Healthy:  svc.Valid,
+					Metadata: svc.Metadata,
+				})
+			}
+
+			next := toInstances(instances)
+			nextByKey := make(map[string]registry.ServiceInstance, len(next))
+			for _, inst := range next {
+				nextByKey[inst.Key()] = inst
+			}
+
+			for key, inst := range nextByKey {
+				if prev, ok := seen[key]; !ok || !prev.Equal(inst) {
+					send(registry.RegistryEvent{Type: registry.EventTypePut, Instance: inst})
+				}
+			}
+			for key, inst := range seen {
+				if _, ok := nextByKey[key]; !ok {
+					send(registry.RegistryEvent{Type: registry.EventTypeDelete, Instance: inst})
+				}
+			}
+			seen = nextByKey
+		},
+	}
+
+	if err := r.client.Subscribe(param); err != nil {
+		close(ch)
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		r.client.Unsubscribe(param)
+		mu.Lock()
+		closed = true
+		mu.Unlock()
+		close(ch)
+	}()
+
+	return ch, nil
+}
+
+// Close implements registry.Registry.
+func (r *Registry) Close() error {
+	return nil
+}
+
+func toInstances(instances []model.Instance) []registry.ServiceInstance {
+	result := make([]registry.ServiceInstance, 0, len(instances))
+	for _, in := range instances {
+		if !in.Healthy {
+			continue
+		}
+		meta := in.Metadata
+		inst := registry.ServiceInstance{
+			Network:  meta["network"],
+			Address:  in.Ip + ":" + strconv.Itoa(int(in.Port)),
+			Weight:   int(in.Weight),
+			Group:    meta["group"],
+			State:    "active",
+			Metadata: meta,
+		}
+		if inst.Network == "" {
+			inst.Network = "tcp"
+		}
+		if lat, ok := meta["latitude"]; ok {
+			if f, err := strconv.ParseFloat(lat, 64); err == nil {
+				inst.Latitude = f
+			}
+		}
+		if lng, ok := meta["longitude"]; ok {
+			if f, err := strconv.ParseFloat(lng, 64); err == nil {
+				inst.Longitude = f
+			}
+		}
+		values := url.Values{}
+		for k, v := range meta {
+			values.Set(k, v)
+		}
+		inst.Raw = values.Encode()
+		result = append(result, inst)
+	}
+	return result
+}
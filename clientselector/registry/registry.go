@@ -0,0 +1,77 @@
+// Package registry abstracts the service-discovery backend used by
+// clientselector. Any backend that can list and watch a set of service
+// instances (etcd, Consul, Nacos, ...) can be plugged in without touching
+// the select-mode logic in clientselector.
+package registry
+
+import "golang.org/x/net/context"
+
+// ServiceInstance describes a single registered server instance. It carries
+// everything the existing select modes (WeightedRoundRobin, WeightedICMP,
+// Closest, ...) need, regardless of which backend produced it.
+type ServiceInstance struct {
+	Network   string
+	Address   string
+	Weight    int
+	Group     string
+	State     string // "active" unless the backend reports otherwise
+	Latitude  float64
+	Longitude float64
+	Metadata  map[string]string
+	// Raw is the backend's original metadata encoding (e.g. the raw etcd
+	// value, a url-encoded query string for Consul/Nacos). Select modes
+	// that parse metadata themselves (Closest) key off this instead of
+	// Metadata so they keep working unchanged across backends.
+	Raw string
+}
+
+// Key returns the "network@address" form used as a map key throughout
+// clientselector.
+func (s ServiceInstance) Key() string {
+	return s.Network + "@" + s.Address
+}
+
+// Equal reports whether s and other describe the same instance state.
+// Metadata itself is skipped in favor of Raw, its canonical encoding, so
+// backends can diff by value with a plain ==-style comparison instead of a
+// deep map comparison.
+func (s ServiceInstance) Equal(other ServiceInstance) bool {
+	return s.Network == other.Network &&
+		s.Address == other.Address &&
+		s.Weight == other.Weight &&
+		s.Group == other.Group &&
+		s.State == other.State &&
+		s.Latitude == other.Latitude &&
+		s.Longitude == other.Longitude &&
+		s.Raw == other.Raw
+}
+
+// EventType identifies whether a RegistryEvent is an upsert or a removal.
+type EventType int
+
+const (
+	// EventTypePut is emitted when an instance is registered or updated.
+	EventTypePut EventType = iota
+	// EventTypeDelete is emitted when an instance is deregistered.
+	EventTypeDelete
+)
+
+// RegistryEvent is a single incremental change to the watched service.
+type RegistryEvent struct {
+	Type     EventType
+	Instance ServiceInstance
+}
+
+// Registry is the pluggable service-discovery backend interface.
+// Implementations live in sibling packages (etcdv3, consul, nacos, ...).
+type Registry interface {
+	// List returns the full, current set of instances for the service.
+	List(ctx context.Context) ([]ServiceInstance, error)
+	// Watch streams incremental RegistryEvents for the service. The
+	// returned channel is closed when ctx is canceled or the backend
+	// connection is irrecoverably lost.
+	Watch(ctx context.Context) (<-chan RegistryEvent, error)
+	// Close releases any resources (connections, background goroutines)
+	// held by the Registry.
+	Close() error
+}
@@ -0,0 +1,619 @@
+package clientselector
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/smallnest/rpcx"
+	"github.com/smallnest/rpcx/clientselector/registry"
+	"github.com/smallnest/rpcx/core"
+	"github.com/smallnest/rpcx/log"
+	"golang.org/x/net/context"
+)
+
+// serverStat tracks the live load of a single server for LeastLoaded/P2C:
+// the number of calls currently in flight, and an exponentially weighted
+// moving average of its RTT in nanoseconds. Both fields are updated with
+// atomics so Select can read them without taking clientRWMutex.
+type serverStat struct {
+	outstanding int64
+	ewmaRTT     int64
+}
+
+const ewmaAlpha = 0.2
+
+func (st *serverStat) start() {
+	atomic.AddInt64(&st.outstanding, 1)
+}
+
+// fail releases an outstanding-call slot without touching EWMA latency,
+// for calls that errored out instead of completing normally.
+func (st *serverStat) fail() {
+	atomic.AddInt64(&st.outstanding, -1)
+}
+
+func (st *serverStat) done(rtt time.Duration) {
+	atomic.AddInt64(&st.outstanding, -1)
+	for {
+		old := atomic.LoadInt64(&st.ewmaRTT)
+		next := int64(rtt)
+		if old != 0 {
+			next = int64(float64(old)*(1-ewmaAlpha) + float64(rtt)*ewmaAlpha)
+		}
+		if atomic.CompareAndSwapInt64(&st.ewmaRTT, old, next) {
+			return
+		}
+	}
+}
+
+// score combines outstanding calls and EWMA latency into a single number
+// for P2C to compare. Each outstanding call counts as one second of
+// latency: between servers with equal outstanding counts latency decides,
+// and an EWMA latency gap of more than k seconds outweighs a difference of
+// k outstanding calls.
+func (st *serverStat) score() float64 {
+	return float64(atomic.LoadInt64(&st.outstanding))*float64(time.Second) + float64(atomic.LoadInt64(&st.ewmaRTT))
+}
+
+// ClientSelector selects a rpc server out of the instances reported by a
+// registry.Registry. It is backend-agnostic: etcd, Consul and Nacos all
+// plug in through the same Registry interface, so the weighted
+// round-robin / closest / consistent-hash select modes below work
+// identically regardless of which one is in use.
+type ClientSelector struct {
+	registry registry.Registry
+
+	Servers            []string
+	Group              string
+	clientAndServer    map[string]*core.Client
+	clientRWMutex      sync.RWMutex
+	metadata           map[string]string
+	Latitude           float64
+	Longitude          float64
+	WeightedServers    []*Weighted
+	SelectMode         rpcx.SelectMode
+	dailTimeout        time.Duration
+	rnd                *rand.Rand
+	currentServer      int
+	len                int
+	HashServiceAndArgs HashServiceAndArgs
+	Client             *rpcx.Client
+
+	serverStats map[string]*serverStat
+
+	// FailureThreshold is how many consecutive HandleFailedClient calls a
+	// server tolerates (in the closed state) before its breaker opens.
+	FailureThreshold int
+	// BreakerCooldown is how long an open breaker waits before admitting
+	// a single half-open probe.
+	BreakerCooldown time.Duration
+	// HealthCheckInterval is how often the background health-check dials
+	// every known server. NewClientSelector sets it to 10s and starts the
+	// goroutine with that value (zero would skip it), so changing the field
+	// afterwards, including to zero, has no effect.
+	HealthCheckInterval time.Duration
+
+	breakers        map[string]*breaker
+	unhealthy       map[string]bool
+	healthCheckStop chan struct{}
+	closeOnce       sync.Once
+
+	// ctx/cancel bound the registry's List/Watch calls so Close can
+	// actually interrupt a blocking Watch (Consul's long poll, Nacos'
+	// unsubscribe goroutine, etcd's watch stream) instead of leaking it.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+const (
+	defaultFailureThreshold    = 5
+	defaultBreakerCooldown     = 30 * time.Second
+	defaultHealthCheckInterval = 10 * time.Second
+)
+
+// NewClientSelector creates a ClientSelector backed by reg. Use this to
+// select over a Consul or Nacos registry.Registry directly; NewEtcdClientSelector
+// and NewEtcdV3ClientSelector remain the shortcuts for etcd.
+func NewClientSelector(reg registry.Registry, group string, sm rpcx.SelectMode, dailTimeout time.Duration) *ClientSelector {
+	ctx, cancel := context.WithCancel(context.Background())
+	selector := &ClientSelector{
+		registry:            reg,
+		ctx:                 ctx,
+		cancel:              cancel,
+		Group:               group,
+		SelectMode:          sm,
+		dailTimeout:         dailTimeout,
+		clientAndServer:     make(map[string]*core.Client),
+		metadata:            make(map[string]string),
+		serverStats:         make(map[string]*serverStat),
+		breakers:            make(map[string]*breaker),
+		unhealthy:           make(map[string]bool),
+		healthCheckStop:     make(chan struct{}),
+		FailureThreshold:    defaultFailureThreshold,
+		BreakerCooldown:     defaultBreakerCooldown,
+		HealthCheckInterval: defaultHealthCheckInterval,
+		rnd:                 rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+	selector.start()
+	return selector
+}
+
+//SetClient set a Client in order that clientSelector can uses it
+func (s *ClientSelector) SetClient(c *rpcx.Client) {
+	s.Client = c
+}
+
+//SetSelectMode sets SelectMode
+func (s *ClientSelector) SetSelectMode(sm rpcx.SelectMode) {
+	s.SelectMode = sm
+}
+
+//AllClients returns core.Clients to all servers
+func (s *ClientSelector) AllClients(clientCodecFunc rpcx.ClientCodecFunc) []*core.Client {
+	var clients []*core.Client
+
+	for _, sv := range s.Servers {
+		ss := strings.Split(sv, "@")
+		c, err := rpcx.NewDirectRPCClient(s.Client, clientCodecFunc, ss[0], ss[1], s.dailTimeout)
+		if err != nil {
+			log.Errorf("rpc client connect server failed: %v", err.Error())
+			continue
+		} else {
+			clients = append(clients, c)
+		}
+	}
+
+	return clients
+}
+
+func (s *ClientSelector) start() {
+	instances, err := s.registry.List(s.ctx)
+	if err != nil {
+		log.Errorf("registry list failed: %v", err.Error())
+	} else {
+		s.applyList(instances)
+	}
+
+	go s.watch()
+	if s.HealthCheckInterval > 0 {
+		go s.healthCheck()
+	}
+}
+
+// healthCheck dials every known server on HealthCheckInterval and marks it
+// unhealthy/healthy directly, so a dead server is taken out of rotation
+// without waiting for the registry's own TTL/health mechanism to notice.
+func (s *ClientSelector) healthCheck() {
+	ticker := time.NewTicker(s.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.healthCheckStop:
+			return
+		case <-ticker.C:
+			s.clientRWMutex.RLock()
+			servers := append([]string(nil), s.Servers...)
+			s.clientRWMutex.RUnlock()
+
+			for _, server := range servers {
+				ss := strings.SplitN(server, "@", 2)
+				if len(ss) != 2 {
+					continue
+				}
+				conn, err := net.DialTimeout(ss[0], ss[1], s.dailTimeout)
+				if conn != nil {
+					conn.Close()
+				}
+
+				s.clientRWMutex.Lock()
+				s.unhealthy[server] = err != nil
+				s.clientRWMutex.Unlock()
+			}
+		}
+	}
+}
+
+// watchRetryInterval is how long watch waits before retrying registry.Watch
+// after it fails outright (as opposed to a channel closing normally on
+// disconnect/compaction, which is retried immediately).
+const watchRetryInterval = time.Second
+
+func (s *ClientSelector) watch() {
+	for {
+		ch, err := s.registry.Watch(s.ctx)
+		if err != nil {
+			log.Errorf("registry watch failed: %v", err.Error())
+			if !s.sleepOrDone(watchRetryInterval) {
+				return
+			}
+			continue
+		}
+
+		for ev := range ch {
+			switch ev.Type {
+			case registry.EventTypePut:
+				s.applyEvent(ev.Instance, true)
+			case registry.EventTypeDelete:
+				s.applyEvent(ev.Instance, false)
+			}
+		}
+
+		select {
+		case <-s.ctx.Done():
+			// Close was called: the registry's Watch tore down its
+			// connection/goroutine on its own, nothing left to re-establish.
+			return
+		default:
+		}
+
+		// the watch channel closed, most likely because of a disconnect or
+		// a compaction; fall back to a full List and re-establish the watch.
+		if instances, err := s.registry.List(s.ctx); err == nil {
+			s.applyList(instances)
+		}
+	}
+}
+
+// sleepOrDone sleeps for d, returning false early if Close is called first.
+func (s *ClientSelector) sleepOrDone(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-s.ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// pingWeight ICMP-pings server's host and converts the RTT into a
+// WeightedICMP weight. Shared by applyList (full re-pull) and applyEvent
+// (a single server joining incrementally), so WeightedICMP reflects a
+// fresh RTT in both cases instead of only on startup/re-watch.
+func pingWeight(server string) int {
+	ss := strings.Split(server, "@")
+	host, _, _ := net.SplitHostPort(ss[1])
+	rtt, _ := Ping(host)
+	return CalculateWeight(rtt)
+}
+
+// applyList replaces the full server set, e.g. on startup or after a watch
+// is re-established.
+func (s *ClientSelector) applyList(instances []registry.ServiceInstance) {
+	s.clientRWMutex.Lock()
+	defer s.clientRWMutex.Unlock()
+
+	servers := make([]string, 0, len(instances))
+	weighted := make([]*Weighted, 0, len(instances))
+	metadata := make(map[string]string, len(instances))
+
+	for _, inst := range instances {
+		if s.Group != inst.Group {
+			continue
+		}
+		key := inst.Key()
+		servers = append(servers, key)
+		weighted = append(weighted, &Weighted{Server: key, Weight: inst.Weight, EffectiveWeight: inst.Weight})
+		metadata[key] = inst.Raw
+	}
+
+	s.Servers = servers
+	s.WeightedServers = weighted
+	s.metadata = metadata
+
+	for key := range s.serverStats {
+		if _, ok := metadata[key]; !ok {
+			delete(s.serverStats, key)
+		}
+	}
+	for key := range s.breakers {
+		if _, ok := metadata[key]; !ok {
+			delete(s.breakers, key)
+		}
+	}
+	for key := range s.unhealthy {
+		if _, ok := metadata[key]; !ok {
+			delete(s.unhealthy, key)
+		}
+	}
+
+	if s.SelectMode == rpcx.WeightedICMP {
+		for _, w := range s.WeightedServers {
+			rtt := pingWeight(w.Server.(string))
+			w.Weight = rtt
+			w.EffectiveWeight = rtt
+		}
+	}
+
+	s.len = len(s.Servers)
+	if s.len > 0 {
+		s.currentServer = s.currentServer % s.len
+	}
+}
+
+// applyEvent mutates Servers/WeightedServers/metadata/clientAndServer for a
+// single instance change under a single write lock, preserving
+// EffectiveWeight/CurrentWeight for every other server.
+func (s *ClientSelector) applyEvent(inst registry.ServiceInstance, active bool) {
+	key := inst.Key()
+	if active && s.Group != inst.Group {
+		active = false
+	}
+
+	s.clientRWMutex.Lock()
+	defer s.clientRWMutex.Unlock()
+
+	index := -1
+	for i, sv := range s.Servers {
+		if sv == key {
+			index = i
+			break
+		}
+	}
+
+	switch {
+	case index >= 0 && active:
+		s.WeightedServers[index].Weight = inst.Weight
+		s.metadata[key] = inst.Raw
+	case index >= 0 && !active:
+		s.Servers = append(s.Servers[:index], s.Servers[index+1:]...)
+		s.WeightedServers = append(s.WeightedServers[:index], s.WeightedServers[index+1:]...)
+		delete(s.metadata, key)
+		delete(s.serverStats, key)
+		delete(s.breakers, key)
+		delete(s.unhealthy, key)
+		if c := s.clientAndServer[key]; c != nil {
+			delete(s.clientAndServer, key)
+			c.Close()
+		}
+	case index < 0 && active:
+		weight := inst.Weight
+		if s.SelectMode == rpcx.WeightedICMP {
+			weight = pingWeight(key)
+		}
+		s.Servers = append(s.Servers, key)
+		s.WeightedServers = append(s.WeightedServers, &Weighted{Server: key, Weight: weight, EffectiveWeight: weight})
+		s.metadata[key] = inst.Raw
+	}
+
+	s.len = len(s.Servers)
+	if s.len > 0 {
+		s.currentServer = s.currentServer % s.len
+	}
+}
+
+// statFor returns the serverStat for server, creating it on first use.
+// It takes clientRWMutex itself (the read lock when server is already
+// tracked, the write lock only to create its entry), so callers must not
+// hold clientRWMutex.
+func (s *ClientSelector) statFor(server string) *serverStat {
+	s.clientRWMutex.RLock()
+	st := s.serverStats[server]
+	s.clientRWMutex.RUnlock()
+	if st != nil {
+		return st
+	}
+
+	s.clientRWMutex.Lock()
+	defer s.clientRWMutex.Unlock()
+	if st = s.serverStats[server]; st == nil {
+		st = &serverStat{}
+		s.serverStats[server] = st
+	}
+	return st
+}
+
+// serverForClient returns the server key client is cached under, the same
+// way HandleFailedClient looks one up: by value, since that's all a generic
+// Call/Done hook on core.Client has to go on.
+func (s *ClientSelector) serverForClient(client *core.Client) (string, bool) {
+	s.clientRWMutex.RLock()
+	defer s.clientRWMutex.RUnlock()
+	for k, v := range s.clientAndServer {
+		if v == client {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// Done reports that a call dispatched on client finished successfully,
+// releasing its server's outstanding-call slot, folding rtt into its EWMA
+// latency and closing its circuit breaker. A Call/Done hook on core.Client
+// should invoke this once per successful call, the same way it would call
+// HandleFailedClient on a failed one.
+func (s *ClientSelector) Done(client *core.Client, rtt time.Duration) {
+	server, ok := s.serverForClient(client)
+	if !ok {
+		return
+	}
+	s.statFor(server).done(rtt)
+	s.breakerFor(server).onSuccess()
+}
+
+// breakerFor returns the breaker for server, creating it on first use.
+func (s *ClientSelector) breakerFor(server string) *breaker {
+	s.clientRWMutex.RLock()
+	b := s.breakers[server]
+	s.clientRWMutex.RUnlock()
+	if b != nil {
+		return b
+	}
+
+	s.clientRWMutex.Lock()
+	defer s.clientRWMutex.Unlock()
+	if b = s.breakers[server]; b == nil {
+		b = &breaker{}
+		s.breakers[server] = b
+	}
+	return b
+}
+
+// eligibleServers returns the subset of Servers (with their matching
+// WeightedServers) that the health-check goroutine hasn't marked unhealthy
+// and whose breaker is at least worth considering. This is a read-only
+// pass: it must not claim a half-open breaker's single probe slot, since
+// most of these candidates will never actually be selected. admitServer
+// does that, for the one server selection settles on.
+func (s *ClientSelector) eligibleServers() ([]string, []*Weighted) {
+	s.clientRWMutex.RLock()
+	defer s.clientRWMutex.RUnlock()
+
+	servers := make([]string, 0, len(s.Servers))
+	weighted := make([]*Weighted, 0, len(s.WeightedServers))
+	for i, sv := range s.Servers {
+		if s.unhealthy[sv] {
+			continue
+		}
+		if b := s.breakers[sv]; b != nil && !b.candidate(s.BreakerCooldown) {
+			continue
+		}
+		servers = append(servers, sv)
+		weighted = append(weighted, s.WeightedServers[i])
+	}
+	return servers, weighted
+}
+
+// admitServer claims the breaker admission (including a half-open probe
+// slot, if any) for the single server a select mode settled on.
+func (s *ClientSelector) admitServer(server string) bool {
+	s.clientRWMutex.RLock()
+	b := s.breakers[server]
+	s.clientRWMutex.RUnlock()
+	if b == nil {
+		return true
+	}
+	return b.allow(s.BreakerCooldown)
+}
+
+// dispatch claims breaker admission for server and, if granted, returns its
+// cached client. This is the only path Select uses to turn a chosen server
+// into a client, so the breaker's half-open probe slot is only ever spent
+// on a server that was actually picked.
+func (s *ClientSelector) dispatch(server string, clientCodecFunc rpcx.ClientCodecFunc) (*core.Client, error) {
+	if !s.admitServer(server) {
+		return nil, errors.New("No available service")
+	}
+	return s.getCachedClient(server, clientCodecFunc)
+}
+
+func (s *ClientSelector) getCachedClient(server string, clientCodecFunc rpcx.ClientCodecFunc) (*core.Client, error) {
+	s.clientRWMutex.RLock()
+	c := s.clientAndServer[server]
+	s.clientRWMutex.RUnlock()
+	if c != nil {
+		return c, nil
+	}
+	ss := strings.Split(server, "@") //
+	c, err := rpcx.NewDirectRPCClient(s.Client, clientCodecFunc, ss[0], ss[1], s.dailTimeout)
+	s.clientRWMutex.Lock()
+	s.clientAndServer[server] = c
+	s.clientRWMutex.Unlock()
+	return c, err
+}
+
+func (s *ClientSelector) HandleFailedClient(client *core.Client) {
+	if server, ok := s.serverForClient(client); ok {
+		s.clientRWMutex.Lock()
+		delete(s.clientAndServer, server)
+		s.clientRWMutex.Unlock()
+		// the call that was in flight on this client will never call
+		// Done, so release its outstanding-call slot here instead.
+		s.statFor(server).fail()
+		s.breakerFor(server).onFailure(s.FailureThreshold)
+	}
+	client.Close()
+}
+
+// Close stops watching the registry and the health-check goroutine, and
+// releases the registry's connection.
+func (s *ClientSelector) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.healthCheckStop)
+		s.cancel()
+	})
+	return s.registry.Close()
+}
+
+// Select returns a rpc client. Servers whose circuit breaker is open, or
+// that the health-check goroutine found unreachable, are skipped.
+func (s *ClientSelector) Select(clientCodecFunc rpcx.ClientCodecFunc, options ...interface{}) (*core.Client, error) {
+	if s.len == 0 {
+		return nil, errors.New("No available service")
+	}
+
+	servers, weighted := s.eligibleServers()
+	n := len(servers)
+	if n == 0 {
+		return nil, errors.New("No available service")
+	}
+
+	switch s.SelectMode {
+	case rpcx.RandomSelect:
+		server := servers[s.rnd.Intn(n)]
+		return s.dispatch(server, clientCodecFunc)
+
+	case rpcx.RoundRobin:
+		s.currentServer = (s.currentServer + 1) % n //not use lock for performance so it is not precise even
+		server := servers[s.currentServer]
+		return s.dispatch(server, clientCodecFunc)
+
+	case rpcx.ConsistentHash:
+		if s.HashServiceAndArgs == nil {
+			s.HashServiceAndArgs = JumpConsistentHash
+		}
+		server := servers[s.HashServiceAndArgs(n, options)]
+		return s.dispatch(server, clientCodecFunc)
+
+	case rpcx.WeightedRoundRobin, rpcx.WeightedICMP:
+		server := nextWeighted(weighted).Server.(string)
+		return s.dispatch(server, clientCodecFunc)
+
+	case rpcx.Closest:
+		eligibleMetadata := make(map[string]string, n)
+		for _, sv := range servers {
+			eligibleMetadata[sv] = s.metadata[sv]
+		}
+		closestServers := getClosestServer(s.Latitude, s.Longitude, eligibleMetadata)
+		selected := s.rnd.Intn(len(closestServers))
+		return s.dispatch(closestServers[selected], clientCodecFunc)
+
+	case LeastLoaded:
+		// fewest outstanding calls wins; EWMA latency only breaks ties.
+		server := servers[0]
+		least := s.statFor(server)
+		for _, sv := range servers[1:] {
+			st := s.statFor(sv)
+			o, lo := atomic.LoadInt64(&st.outstanding), atomic.LoadInt64(&least.outstanding)
+			if o < lo || (o == lo && atomic.LoadInt64(&st.ewmaRTT) < atomic.LoadInt64(&least.ewmaRTT)) {
+				least, server = st, sv
+			}
+		}
+		if !s.admitServer(server) {
+			return nil, errors.New("No available service")
+		}
+		s.statFor(server).start()
+		return s.getCachedClient(server, clientCodecFunc)
+
+	case P2C:
+		a, b := servers[s.rnd.Intn(n)], servers[s.rnd.Intn(n)]
+		server := a
+		if s.statFor(b).score() < s.statFor(a).score() {
+			server = b
+		}
+		if !s.admitServer(server) {
+			return nil, errors.New("No available service")
+		}
+		s.statFor(server).start()
+		return s.getCachedClient(server, clientCodecFunc)
+
+	default:
+		return nil, errors.New("not supported SelectMode: " + s.SelectMode.String())
+	}
+}
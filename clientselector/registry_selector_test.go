@@ -0,0 +1,169 @@
+package clientselector
+
+import (
+	"testing"
+
+	"github.com/smallnest/rpcx"
+	"github.com/smallnest/rpcx/clientselector/registry"
+	"github.com/smallnest/rpcx/core"
+)
+
+// newTestSelector builds a ClientSelector with its maps initialized but no
+// backing registry/background goroutines, so applyList/applyEvent and the
+// breaker/health bookkeeping around them can be tested without a network.
+func newTestSelector(sm rpcx.SelectMode) *ClientSelector {
+	return &ClientSelector{
+		SelectMode:       sm,
+		clientAndServer:  make(map[string]*core.Client),
+		metadata:         make(map[string]string),
+		serverStats:      make(map[string]*serverStat),
+		breakers:         make(map[string]*breaker),
+		unhealthy:        make(map[string]bool),
+		FailureThreshold: defaultFailureThreshold,
+		BreakerCooldown:  defaultBreakerCooldown,
+	}
+}
+
+// TestHandleFailedClientActsOnlyOnTheFailedServer guards against the
+// chunk0-5 regression where HandleFailedClient closed/penalized whatever
+// map entry iteration visited first instead of the server the failed
+// client actually belonged to.
+func TestHandleFailedClientActsOnlyOnTheFailedServer(t *testing.T) {
+	s := newTestSelector(rpcx.RandomSelect)
+	healthy := &core.Client{}
+	failed := &core.Client{}
+	s.clientAndServer["tcp@a"] = healthy
+	s.clientAndServer["tcp@b"] = failed
+
+	s.HandleFailedClient(failed)
+
+	if _, ok := s.clientAndServer["tcp@b"]; ok {
+		t.Fatalf("expected the failed server to be evicted from clientAndServer")
+	}
+	if _, ok := s.clientAndServer["tcp@a"]; !ok {
+		t.Fatalf("HandleFailedClient evicted the wrong server")
+	}
+	b := s.breakers["tcp@b"]
+	if b == nil || b.consecutiveFailures != 1 {
+		t.Fatalf("expected the failed server's breaker to record exactly one failure")
+	}
+	if _, tracked := s.breakers["tcp@a"]; tracked {
+		t.Fatalf("the healthy server's breaker should never have been touched")
+	}
+}
+
+func TestApplyEventAddsAndRemovesServers(t *testing.T) {
+	s := newTestSelector(rpcx.RandomSelect)
+	inst := registry.ServiceInstance{Network: "tcp", Address: "a", Weight: 2}
+
+	s.applyEvent(inst, true)
+	if len(s.Servers) != 1 || s.Servers[0] != inst.Key() {
+		t.Fatalf("expected the instance to be added, got %v", s.Servers)
+	}
+
+	s.applyEvent(inst, false)
+	if len(s.Servers) != 0 {
+		t.Fatalf("expected the instance to be removed, got %v", s.Servers)
+	}
+}
+
+// TestApplyEventPrunesBreakerAndUnhealthyOnRemoval guards against the
+// chunk0-5 regression where breakers/unhealthy grew without bound because
+// only serverStats was pruned when a server left the registry.
+func TestApplyEventPrunesBreakerAndUnhealthyOnRemoval(t *testing.T) {
+	s := newTestSelector(rpcx.RandomSelect)
+	inst := registry.ServiceInstance{Network: "tcp", Address: "a", Weight: 1}
+	s.applyEvent(inst, true)
+
+	key := inst.Key()
+	s.breakers[key] = &breaker{}
+	s.unhealthy[key] = true
+
+	s.applyEvent(inst, false)
+
+	if _, ok := s.breakers[key]; ok {
+		t.Fatalf("expected the breaker for the removed server to be pruned")
+	}
+	if _, ok := s.unhealthy[key]; ok {
+		t.Fatalf("expected the unhealthy entry for the removed server to be pruned")
+	}
+	if _, ok := s.serverStats[key]; ok {
+		t.Fatalf("expected the serverStat for the removed server to be pruned")
+	}
+}
+
+// TestApplyEventPreservesOtherServersWeightedState guards against the
+// chunk0-2 regression where a single incremental update rebuilt
+// WeightedServers from scratch, resetting every other server's round-robin
+// counters in the process.
+func TestApplyEventPreservesOtherServersWeightedState(t *testing.T) {
+	s := newTestSelector(rpcx.WeightedRoundRobin)
+	instA := registry.ServiceInstance{Network: "tcp", Address: "a", Weight: 1}
+	instB := registry.ServiceInstance{Network: "tcp", Address: "b", Weight: 1}
+	s.applyEvent(instA, true)
+	s.applyEvent(instB, true)
+
+	b := s.WeightedServers[1]
+	b.EffectiveWeight = 5
+
+	// a metadata-only update to "a" must not touch "b"'s weighted state.
+	s.applyEvent(registry.ServiceInstance{Network: "tcp", Address: "a", Weight: 1, Raw: "updated"}, true)
+
+	if s.WeightedServers[1].EffectiveWeight != 5 {
+		t.Fatalf("expected b's EffectiveWeight to survive a's update, got %d", s.WeightedServers[1].EffectiveWeight)
+	}
+}
+
+func TestApplyListPrunesRemovedServerBookkeeping(t *testing.T) {
+	s := newTestSelector(rpcx.RandomSelect)
+	s.applyList([]registry.ServiceInstance{
+		{Network: "tcp", Address: "a", Weight: 1},
+		{Network: "tcp", Address: "b", Weight: 1},
+	})
+	s.breakers["tcp@b"] = &breaker{}
+	s.unhealthy["tcp@b"] = true
+
+	s.applyList([]registry.ServiceInstance{{Network: "tcp", Address: "a", Weight: 1}})
+
+	if _, ok := s.breakers["tcp@b"]; ok {
+		t.Fatalf("expected breaker for a server missing from the new list to be pruned")
+	}
+	if _, ok := s.unhealthy["tcp@b"]; ok {
+		t.Fatalf("expected unhealthy entry for a server missing from the new list to be pruned")
+	}
+}
+
+// TestEligibleServersAndAdmitServerSplitReadFromClaim guards against the
+// chunk0-5 regression where building the candidate list itself claimed
+// every open breaker's single half-open probe slot, instead of leaving
+// that to the server a select mode actually settles on.
+func TestEligibleServersAndAdmitServerSplitReadFromClaim(t *testing.T) {
+	s := newTestSelector(rpcx.RandomSelect)
+	s.Servers = []string{"tcp@a", "tcp@b"}
+	s.WeightedServers = []*Weighted{
+		{Server: "tcp@a", Weight: 1, EffectiveWeight: 1},
+		{Server: "tcp@b", Weight: 1, EffectiveWeight: 1},
+	}
+	b := &breaker{}
+	b.trip()
+	b.openedAt = b.openedAt - int64(s.BreakerCooldown+1)
+	s.breakers["tcp@a"] = b
+
+	servers, weighted := s.eligibleServers()
+	if len(servers) != 2 || len(weighted) != 2 {
+		t.Fatalf("expected both servers to be candidates once cooldown elapsed, got %v", servers)
+	}
+	if breakerState(b.state) != breakerOpen {
+		t.Fatalf("eligibleServers must not claim the half-open probe; state = %v", breakerState(b.state))
+	}
+
+	if !s.admitServer("tcp@a") {
+		t.Fatalf("expected admitServer to claim the probe for the selected server")
+	}
+	if breakerState(b.state) != breakerHalfOpen {
+		t.Fatalf("expected the breaker to move to half-open once admitServer claims it")
+	}
+	if s.admitServer("tcp@a") {
+		t.Fatalf("a second admitServer must not claim a probe that's already in flight")
+	}
+}
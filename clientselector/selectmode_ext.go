@@ -0,0 +1,18 @@
+package clientselector
+
+import "github.com/smallnest/rpcx"
+
+// LeastLoaded and P2C extend rpcx.SelectMode with two load-aware modes.
+// They live here, rather than in the rpcx.SelectMode block itself, because
+// they only make sense for selectors (like ClientSelector) that track
+// per-server outstanding-call and latency stats -- plain round-robin
+// selectors have no use for them. Values start well above the existing
+// enum range so they never collide with a mode added upstream later.
+const (
+	// LeastLoaded picks the server with the fewest outstanding calls.
+	LeastLoaded rpcx.SelectMode = iota + 100
+	// P2C ("power of two choices") samples two servers at random and
+	// picks the one with the lower serverStat score (outstanding calls,
+	// each counted as one second, plus EWMA latency).
+	P2C
+)